@@ -4,6 +4,7 @@ package profile
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -11,7 +12,12 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // memProfileRate holds the rate for the memory profile.
@@ -21,15 +27,19 @@ var memProfileRate = 4096
 var started uint32
 
 const (
-	cpuMode = iota
+	cpuMode = 1 << iota
 	memMode
 	blockMode
+	mutexMode
+	traceMode
 )
 
 var (
 	cpuFlag     = flag.Bool("cpuprofile", false, "Enables CPU profile.")
 	memFlag     = flag.Bool("memprofile", false, "Enables memory profile.")
 	blockFlag   = flag.Bool("blockprofile", false, "Enables goroutine blocking profile.")
+	mutexFlag   = flag.Bool("mutexprofile", false, "Enables mutex profile.")
+	traceFlag   = flag.Bool("traceprofile", false, "Enables execution trace.")
 	memRateFlag = flag.Int("memprofilerate", 0, "Enables memory profile at the given rate.")
 	outputFlag  = flag.String("outputdir", "", "Sets the directory where the profile will be written.")
 )
@@ -42,7 +52,9 @@ type profile struct {
 	// hook SIGINT to write profiles cleanly.
 	noShutdownHook bool
 
-	// mode holds the type of profiling that will be made
+	// mode holds the bitmask of profiling modes that will be made.
+	// More than one mode may be set, enabling several profiles to be
+	// captured during a single Start/Stop cycle.
 	mode int
 
 	// path holds the base path where various profiling files are  written.
@@ -51,6 +63,27 @@ type profile struct {
 
 	// closers holds the cleanup functions that run after each profile
 	closers []func()
+
+	// stopSignal, if set, additionally triggers Stop when received,
+	// without terminating the process.
+	stopSignal os.Signal
+
+	// stopped guards against Stop being run more than once.
+	stopped uint32
+
+	// done is closed when Stop runs, so background goroutines (the
+	// stopSignal handler, Duration's timer, Rotate's ticker) can exit
+	// even if Stop was called some other way.
+	done chan struct{}
+
+	// duration, if non-zero, stops the profile automatically once it
+	// has elapsed.
+	duration time.Duration
+
+	// rotateEvery and rotateKeep configure periodic rotation of the
+	// profile output files; see Rotate.
+	rotateEvery time.Duration
+	rotateKeep  int
 }
 
 // NoShutdownHook controls whether the profiling package should
@@ -63,23 +96,34 @@ func NoShutdownHook(p *profile) { p.noShutdownHook = true }
 // Quiet suppresses informational messages during profiling.
 func Quiet(p *profile) { p.quiet = true }
 
-// CPUProfile controls if cpu profiling will be enabled. It disables any previous profiling settings.
-func CPUProfile(p *profile) { p.mode = cpuMode }
+// CPUProfile controls if cpu profiling will be enabled. It can be combined
+// with other profiling modes, all of which will be captured together.
+func CPUProfile(p *profile) { p.mode |= cpuMode }
 
-// MemProfile controls if memory profiling will be enabled. It disables any previous profiling settings.
-func MemProfile(p *profile) { p.mode = memMode }
+// MemProfile controls if memory profiling will be enabled. It can be combined
+// with other profiling modes, all of which will be captured together.
+func MemProfile(p *profile) { p.mode |= memMode }
 
 // MemProfileRate controls if memory profiling will be enabled. Additionally, it takes a parameter which
 // allows the setting of the memory profile rate.
 func MemProfileRate(rate int) func(*profile) {
 	return func(p *profile) {
 		memProfileRate = rate
-		p.mode = memMode
+		p.mode |= memMode
 	}
 }
 
-// BlockProfile controls if block (contention) profiling will be enabled. It disables any previous profiling settings.
-func BlockProfile(p *profile) { p.mode = blockMode }
+// BlockProfile controls if block (contention) profiling will be enabled. It can be combined
+// with other profiling modes, all of which will be captured together.
+func BlockProfile(p *profile) { p.mode |= blockMode }
+
+// MutexProfile controls if mutex (contention) profiling will be enabled. It can be combined
+// with other profiling modes, all of which will be captured together.
+func MutexProfile(p *profile) { p.mode |= mutexMode }
+
+// TraceProfile controls if execution trace profiling will be enabled. It can be combined
+// with other profiling modes, all of which will be captured together.
+func TraceProfile(p *profile) { p.mode |= traceMode }
 
 // ProfilePath controls the base path where various profiling
 // files are written. If blank, the base path will be generated
@@ -90,38 +134,273 @@ func ProfilePath(path string) func(*profile) {
 	}
 }
 
-// Stop stops the profile and flushes any unwritten data.
+// StopSignal registers sig as an additional trigger for Stop.
+// Unlike the default SIGINT handling, receiving sig flushes and stops
+// profiling without terminating the process, which makes it useful for
+// capturing a bounded profiling window in a long-running service.
+func StopSignal(sig os.Signal) func(*profile) {
+	return func(p *profile) {
+		p.stopSignal = sig
+	}
+}
+
+// Duration arranges for Stop to be called automatically once d has
+// elapsed, so a profiling window can be bounded without the caller
+// having to manage its own timer.
+func Duration(d time.Duration) func(*profile) {
+	return func(p *profile) {
+		p.duration = d
+	}
+}
+
+// Rotate enables periodic rotation of the profile output: every d, the
+// current output file is closed, a new timestamped one is opened in its
+// place, and files beyond the most recent keep (the current file included)
+// are pruned; a keep of zero or less disables pruning. This is meant
+// for always-on profiling in long-running services, where a single
+// profile file would otherwise grow unbounded or miss transient issues.
+func Rotate(d time.Duration, keep int) func(*profile) {
+	return func(p *profile) {
+		p.rotateEvery = d
+		p.rotateKeep = keep
+	}
+}
+
+// Stop stops the profile and flushes any unwritten data. It is safe to
+// call Stop more than once; only the first call has any effect.
 func (p *profile) Stop() {
+	if !atomic.CompareAndSwapUint32(&p.stopped, 0, 1) {
+		return
+	}
 	for _, c := range p.closers {
 		c()
 	}
+	if p.done != nil {
+		close(p.done)
+	}
+}
+
+// envModes maps the names accepted by the PROFILER environment variable
+// to their profiling mode bits.
+var envModes = map[string]int{
+	"cpu":   cpuMode,
+	"mem":   memMode,
+	"block": blockMode,
+	"mutex": mutexMode,
+	"trace": traceMode,
+}
+
+// parseEnv analyzes the PROFILER, PROFILER_OUTPUT, and PROFILER_MEMRATE
+// environment variables and applies them to the given profile. It is meant
+// for servers embedded in orchestration systems that want to toggle
+// profiling on a single instance without changing argv.
+func parseEnv(p *profile) {
+	if v := os.Getenv("PROFILER"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if mode, ok := envModes[strings.TrimSpace(name)]; ok {
+				p.mode |= mode
+			}
+		}
+	}
+
+	if v := os.Getenv("PROFILER_MEMRATE"); v != "" {
+		if rate, err := strconv.Atoi(v); err == nil {
+			memProfileRate = rate
+			p.mode |= memMode
+		}
+	}
+
+	if v := os.Getenv("PROFILER_OUTPUT"); v != "" {
+		p.path = v
+	}
 }
 
 // parseFlags analyzes the command line flags and applies them to the given profile.
 func parseFlags(p *profile) {
 	flag.Parse()
 
-	switch true {
-	case *cpuFlag:
-		p.mode = cpuMode
-	case *memFlag:
-		p.mode = memMode
-	case *blockFlag:
-		p.mode = blockMode
+	if *cpuFlag {
+		p.mode |= cpuMode
+	}
+	if *memFlag {
+		p.mode |= memMode
+	}
+	if *blockFlag {
+		p.mode |= blockMode
+	}
+	if *mutexFlag {
+		p.mode |= mutexMode
+	}
+	if *traceFlag {
+		p.mode |= traceMode
 	}
 
 	if *memRateFlag != 0 {
 		memProfileRate = *memRateFlag
-		p.mode = memMode
+		p.mode |= memMode
 	}
 	if *outputFlag != "" {
 		p.path = *outputFlag
 	}
 }
 
+// rotatedName builds the timestamped filename used for a rotated profile,
+// e.g. "cpu-20060102T150405.000.pprof" (the timestamp carries milliseconds).
+func rotatedName(dir, prefix, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.%s", prefix, time.Now().Format("20060102T150405.000"), ext))
+}
+
+// pruneOldest removes the oldest files in excess of keep, returning the
+// remaining, still-live subset in the same (oldest-first) order.
+func pruneOldest(files []string, keep int) []string {
+	for len(files) > keep {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			log.Printf("profile: could not remove rotated file %q: %v", files[0], err)
+		}
+		files = files[1:]
+	}
+	return files
+}
+
+// addSnapshotProfile wires up a profiling mode whose data is dumped on
+// demand via write, such as the heap, block, and mutex pprof profiles.
+// enable/disable toggle the underlying runtime instrumentation for the
+// lifetime of the profile. When prof.rotateEvery is set, write is also
+// called periodically against fresh, timestamped files.
+func (prof *profile) addSnapshotProfile(dir, prefix, ext, note string, enable, disable func(), write func(*os.File)) {
+	enable()
+
+	var (
+		mu    sync.Mutex
+		files []string
+	)
+	open := func() *os.File {
+		fn := filepath.Join(dir, prefix+"."+ext)
+		if prof.rotateEvery > 0 {
+			fn = rotatedName(dir, prefix, ext)
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			log.Fatalf("profile: could not create %s profile %q: %v", prefix, fn, err)
+		}
+		files = append(files, fn)
+		return f
+	}
+
+	cur := open()
+	if !prof.quiet {
+		log.Printf("profile: %s profiling enabled%s, %s", prefix, note, cur.Name())
+	}
+
+	if prof.rotateEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(prof.rotateEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					mu.Lock()
+					if atomic.LoadUint32(&prof.stopped) == 1 {
+						mu.Unlock()
+						return
+					}
+					write(cur)
+					cur.Close()
+					cur = open()
+					if prof.rotateKeep > 0 {
+						files = pruneOldest(files, prof.rotateKeep)
+					}
+					mu.Unlock()
+				case <-prof.done:
+					return
+				}
+			}
+		}()
+	}
+
+	prof.closers = append(prof.closers, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		write(cur)
+		cur.Close()
+		disable()
+	})
+}
+
+// addContinuousProfile wires up a profiling mode that records
+// continuously into its output file, such as the CPU profile and
+// execution trace. Unlike a snapshot profile, rotating it requires
+// stopping and restarting the recorder against a new file.
+func (prof *profile) addContinuousProfile(dir, prefix, ext string, start func(*os.File) error, stop func()) {
+	var (
+		mu    sync.Mutex
+		files []string
+	)
+	open := func() *os.File {
+		fn := filepath.Join(dir, prefix+"."+ext)
+		if prof.rotateEvery > 0 {
+			fn = rotatedName(dir, prefix, ext)
+		}
+		f, err := os.Create(fn)
+		if err != nil {
+			log.Fatalf("profile: could not create %s profile %q: %v", prefix, fn, err)
+		}
+		files = append(files, fn)
+		return f
+	}
+
+	cur := open()
+	if !prof.quiet {
+		log.Printf("profile: %s profiling enabled, %s", prefix, cur.Name())
+	}
+	if err := start(cur); err != nil {
+		log.Fatalf("profile: could not start %s profile: %v", prefix, err)
+	}
+
+	if prof.rotateEvery > 0 {
+		go func() {
+			ticker := time.NewTicker(prof.rotateEvery)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					mu.Lock()
+					if atomic.LoadUint32(&prof.stopped) == 1 {
+						mu.Unlock()
+						return
+					}
+					stop()
+					cur.Close()
+					cur = open()
+					if prof.rotateKeep > 0 {
+						files = pruneOldest(files, prof.rotateKeep)
+					}
+					if err := start(cur); err != nil {
+						log.Fatalf("profile: could not restart %s profile: %v", prefix, err)
+					}
+					mu.Unlock()
+				case <-prof.done:
+					return
+				}
+			}
+		}()
+	}
+
+	prof.closers = append(prof.closers, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stop()
+		cur.Close()
+	})
+}
+
 // Start starts a new profiling session.
 // The caller should call the Stop method on the value returned
 // to cleanly stop profiling.
+//
+// Configuration is merged from, in increasing order of precedence, the
+// PROFILER* environment variables, command-line flags, and the options
+// passed explicitly.
 func Start(options ...func(*profile)) interface {
 	Stop()
 } {
@@ -130,10 +409,11 @@ func Start(options ...func(*profile)) interface {
 	}
 
 	var prof profile
+	parseEnv(&prof)
+	parseFlags(&prof)
 	for _, option := range options {
 		option(&prof)
 	}
-	parseFlags(&prof)
 
 	path, err := func() (string, error) {
 		if p := prof.path; p != "" {
@@ -146,72 +426,97 @@ func Start(options ...func(*profile)) interface {
 		log.Fatalf("profile: could not create initial output directory: %v", err)
 	}
 
-	switch prof.mode {
-	case cpuMode:
-		fn := filepath.Join(path, "cpu.pprof")
-		f, err := os.Create(fn)
-		if err != nil {
-			log.Fatalf("profile: could not create cpu profile %q: %v", fn, err)
-		}
-		if !prof.quiet {
-			log.Printf("profile: cpu profiling enabled, %s", fn)
-		}
-		pprof.StartCPUProfile(f)
-		prof.closers = append(prof.closers, func() {
-			pprof.StopCPUProfile()
-			f.Close()
-		})
-
-	case memMode:
-		fn := filepath.Join(path, "mem.pprof")
-		f, err := os.Create(fn)
-		if err != nil {
-			log.Fatalf("profile: could not create memory profile %q: %v", fn, err)
-		}
+	prof.done = make(chan struct{})
+
+	if prof.mode&cpuMode != 0 {
+		prof.addContinuousProfile(path, "cpu", "pprof",
+			func(f *os.File) error { return pprof.StartCPUProfile(f) },
+			pprof.StopCPUProfile)
+	}
+
+	if prof.mode&memMode != 0 {
 		old := runtime.MemProfileRate
-		runtime.MemProfileRate = memProfileRate
-		if !prof.quiet {
-			log.Printf("profile: memory profiling enabled (rate %d), %s", memProfileRate, fn)
-		}
-		prof.closers = append(prof.closers, func() {
-			pprof.Lookup("heap").WriteTo(f, 0)
-			f.Close()
-			runtime.MemProfileRate = old
-		})
-
-	case blockMode:
-		fn := filepath.Join(path, "block.pprof")
-		f, err := os.Create(fn)
-		if err != nil {
-			log.Fatalf("profile: could not create block profile %q: %v", fn, err)
-		}
-		runtime.SetBlockProfileRate(1)
-		if !prof.quiet {
-			log.Printf("profile: block profiling enabled, %s", fn)
-		}
-		prof.closers = append(prof.closers, func() {
-			pprof.Lookup("block").WriteTo(f, 0)
-			f.Close()
-			runtime.SetBlockProfileRate(0)
-		})
+		prof.addSnapshotProfile(path, "mem", "pprof", fmt.Sprintf(" (rate %d)", memProfileRate),
+			func() { runtime.MemProfileRate = memProfileRate },
+			func() { runtime.MemProfileRate = old },
+			func(f *os.File) { pprof.Lookup("heap").WriteTo(f, 0) })
+	}
+
+	if prof.mode&blockMode != 0 {
+		prof.addSnapshotProfile(path, "block", "pprof", "",
+			func() { runtime.SetBlockProfileRate(1) },
+			func() { runtime.SetBlockProfileRate(0) },
+			func(f *os.File) { pprof.Lookup("block").WriteTo(f, 0) })
+	}
+
+	if prof.mode&mutexMode != 0 {
+		prof.addSnapshotProfile(path, "mutex", "pprof", "",
+			func() { runtime.SetMutexProfileFraction(1) },
+			func() { runtime.SetMutexProfileFraction(0) },
+			func(f *os.File) { pprof.Lookup("mutex").WriteTo(f, 0) })
+	}
+
+	if prof.mode&traceMode != 0 {
+		prof.addContinuousProfile(path, "trace", "out",
+			func(f *os.File) error { return trace.Start(f) },
+			trace.Stop)
+	}
+
+	prof.closers = append(prof.closers, func() {
+		atomic.SwapUint32(&started, 0)
+	})
+
+	// Every closer above must be registered before any goroutine that can
+	// call Stop is started, since Stop iterates prof.closers unguarded by
+	// anything but p.stopped.
+	if prof.duration > 0 {
+		go func() {
+			timer := time.NewTimer(prof.duration)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				if !prof.quiet {
+					log.Printf("profile: duration %v elapsed, stopping profiles", prof.duration)
+				}
+				prof.Stop()
+			case <-prof.done:
+			}
+		}()
 	}
 
 	if !prof.noShutdownHook {
 		go func() {
 			c := make(chan os.Signal, 1)
 			signal.Notify(c, os.Interrupt)
-			<-c
+			defer signal.Stop(c)
 
-			log.Println("profile: caught interrupt, stopping profiles")
-			prof.Stop()
+			select {
+			case <-c:
+				log.Println("profile: caught interrupt, stopping profiles")
+				prof.Stop()
 
-			os.Exit(0)
+				os.Exit(0)
+			case <-prof.done:
+			}
 		}()
 	}
 
-	prof.closers = append(prof.closers, func() {
-		atomic.SwapUint32(&started, 0)
-	})
+	if prof.stopSignal != nil {
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, prof.stopSignal)
+			defer signal.Stop(c)
+
+			select {
+			case <-c:
+				if !prof.quiet {
+					log.Printf("profile: caught %v, stopping profiles", prof.stopSignal)
+				}
+				prof.Stop()
+			case <-prof.done:
+			}
+		}()
+	}
 
 	return &prof
 }
@@ -0,0 +1,166 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStartMultipleModes(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(CPUProfile, MemProfile, BlockProfile, MutexProfile, Quiet, NoShutdownHook, ProfilePath(dir))
+	p.Stop()
+
+	for _, fn := range []string{"cpu.pprof", "mem.pprof", "block.pprof", "mutex.pprof"} {
+		path := filepath.Join(dir, fn)
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be written: %v", fn, err)
+		}
+	}
+}
+
+func TestStartSingleMode(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(TraceProfile, Quiet, NoShutdownHook, ProfilePath(dir))
+	p.Stop()
+
+	path := filepath.Join(dir, "trace.out")
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected trace.out to be written: %v", err)
+	}
+}
+
+func TestStopIsIdempotent(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(CPUProfile, Quiet, NoShutdownHook, ProfilePath(dir))
+	p.Stop()
+	p.Stop()
+}
+
+// waitStopped blocks until a Stop triggered from another goroutine (by a
+// signal, Duration, etc.) has fully run, so the next Start in the test
+// binary doesn't race the reset of the package-level started guard.
+func waitStopped(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadUint32(&started) == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for profiling to stop")
+}
+
+func TestStopSignal(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(CPUProfile, Quiet, NoShutdownHook, StopSignal(syscall.SIGUSR1), ProfilePath(dir))
+	defer p.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	waitStopped(t)
+
+	path := filepath.Join(dir, "cpu.pprof")
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected StopSignal to flush %s", path)
+	}
+}
+
+func TestParseEnvModes(t *testing.T) {
+	t.Setenv("PROFILER", "cpu,block")
+
+	var p profile
+	parseEnv(&p)
+
+	if p.mode != cpuMode|blockMode {
+		t.Errorf("got mode %b, want %b", p.mode, cpuMode|blockMode)
+	}
+}
+
+func TestParseEnvMemRate(t *testing.T) {
+	t.Setenv("PROFILER_MEMRATE", "1024")
+
+	old := memProfileRate
+	defer func() { memProfileRate = old }()
+
+	var p profile
+	parseEnv(&p)
+
+	if memProfileRate != 1024 {
+		t.Errorf("got memProfileRate %d, want 1024", memProfileRate)
+	}
+	if p.mode&memMode == 0 {
+		t.Error("expected PROFILER_MEMRATE to enable memMode")
+	}
+}
+
+func TestEnvPrecedenceBelowOptions(t *testing.T) {
+	envDir := t.TempDir()
+	optDir := t.TempDir()
+	t.Setenv("PROFILER_OUTPUT", envDir)
+
+	p := Start(CPUProfile, Quiet, NoShutdownHook, ProfilePath(optDir))
+	p.Stop()
+
+	if _, err := os.Stat(filepath.Join(optDir, "cpu.pprof")); err != nil {
+		t.Errorf("expected explicit ProfilePath option to win over PROFILER_OUTPUT: %v", err)
+	}
+}
+
+func TestDurationStopsAutomatically(t *testing.T) {
+	dir := t.TempDir()
+
+	Start(CPUProfile, Quiet, NoShutdownHook, ProfilePath(dir), Duration(50*time.Millisecond))
+	waitStopped(t)
+
+	path := filepath.Join(dir, "cpu.pprof")
+	if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+		t.Fatalf("expected Duration to stop the profile and flush %s", path)
+	}
+}
+
+func TestRotateSnapshotProfile(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(MemProfile, Quiet, NoShutdownHook, ProfilePath(dir), Rotate(30*time.Millisecond, 2))
+	time.Sleep(110 * time.Millisecond)
+	p.Stop()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "mem-*.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatal("expected at least one rotated mem profile")
+	}
+	if len(matches) > 2 {
+		t.Errorf("expected at most keep(2) rotated files to remain, got %d: %v", len(matches), matches)
+	}
+}
+
+func TestRotateContinuousProfile(t *testing.T) {
+	dir := t.TempDir()
+
+	p := Start(CPUProfile, Quiet, NoShutdownHook, ProfilePath(dir), Rotate(30*time.Millisecond, 2))
+	time.Sleep(110 * time.Millisecond)
+	p.Stop()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "cpu-*.pprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 {
+		t.Fatal("expected at least one rotated cpu profile")
+	}
+	if len(matches) > 2 {
+		t.Errorf("expected at most keep(2) rotated files to remain, got %d: %v", len(matches), matches)
+	}
+}